@@ -0,0 +1,243 @@
+package dohProxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultMaxNegativeTTL = 5 * time.Minute
+	defaultStaleTTL       = 24 * time.Hour
+	staleAnswerTTL        = 30 // seconds; TTL handed out for stale-while-revalidate answers
+
+	reapInterval = 1 * time.Minute // how often the background reaper sweeps expired entries
+)
+
+// cacheKey identifies a cacheable question. The EDNS0 client-subnet is part
+// of the key so subnet-specific answers are never cross-served to a client
+// in a different subnet.
+type cacheKey struct {
+	qname  string
+	qtype  uint16
+	qclass uint16
+	subnet string
+}
+
+type cacheEntry struct {
+	msg        *dns.Msg
+	insertedAt time.Time
+	expiresAt  time.Time
+}
+
+// Cache is a TTL-aware response cache with negative caching (RFC 2308) and
+// an optional stale-while-revalidate mode (RFC 8767).
+type Cache struct {
+	maxNegativeTTL time.Duration
+	staleTTL       time.Duration
+	serveStale     bool
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+// NewCache builds a Cache and starts its background reaper. maxNegativeTTL/
+// staleTTL of zero fall back to their defaults; serveStale enables returning
+// expired entries (within staleTTL) when asked to via GetStale.
+func NewCache(maxNegativeTTL, staleTTL time.Duration, serveStale bool) *Cache {
+	if maxNegativeTTL <= 0 {
+		maxNegativeTTL = defaultMaxNegativeTTL
+	}
+	if staleTTL <= 0 {
+		staleTTL = defaultStaleTTL
+	}
+	c := &Cache{
+		maxNegativeTTL: maxNegativeTTL,
+		staleTTL:       staleTTL,
+		serveStale:     serveStale,
+		entries:        make(map[cacheKey]*cacheEntry),
+	}
+	go c.reapLoop()
+	return c
+}
+
+// reapLoop periodically removes entries past expiry (past expiresAt+staleTTL
+// when serve-stale is enabled, since GetStale can still serve those) so
+// entries that are never looked up again don't accumulate in entries
+// forever.
+func (c *Cache) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.reap()
+	}
+}
+
+func (c *Cache) reap() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		deadline := entry.expiresAt
+		if c.serveStale {
+			deadline = deadline.Add(c.staleTTL)
+		}
+		if now.After(deadline) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func cacheKeyFor(msg *dns.Msg) cacheKey {
+	if len(msg.Question) == 0 {
+		return cacheKey{}
+	}
+	q := msg.Question[0]
+	return cacheKey{
+		qname:  strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		subnet: subnetKey(msg),
+	}
+}
+
+// subnetKey extracts the EDNS0 client-subnet address/prefix carried on msg,
+// if any, as a cache key component.
+func subnetKey(msg *dns.Msg) string {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return fmt.Sprintf("%v/%v", subnet.Address.String(), subnet.SourceNetmask)
+		}
+	}
+	return ""
+}
+
+// Get returns a live cached answer for q, with TTLs decremented by the time
+// elapsed since insertion, or nil if there is no unexpired entry.
+func (c *Cache) Get(q *dns.Msg) *dns.Msg {
+	entry, ok := c.lookup(q)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expiresAt) {
+		return nil
+	}
+	return ageOut(entry.msg, entry.insertedAt, now)
+}
+
+// GetStale returns a cached answer for q even past its expiry, as long as
+// it is within staleTTL and serve-stale is enabled, with TTLs clamped to
+// staleAnswerTTL so downstream caches re-check soon. Returns nil otherwise.
+func (c *Cache) GetStale(q *dns.Msg) *dns.Msg {
+	if !c.serveStale {
+		return nil
+	}
+	entry, ok := c.lookup(q)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expiresAt.Add(c.staleTTL)) {
+		return nil
+	}
+	rMsg := entry.msg.Copy()
+	clampTTLs(rMsg, staleAnswerTTL)
+	return rMsg
+}
+
+func (c *Cache) lookup(q *dns.Msg) (*cacheEntry, bool) {
+	key := cacheKeyFor(q)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+// Insert reads upstream responses off ch and inserts each into the cache,
+// computing its expiry from the lowest TTL across its records, or the SOA
+// MINIMUM (capped at maxNegativeTTL) for a negative (NXDOMAIN/NODATA)
+// response.
+func (c *Cache) Insert(ch chan *dns.Msg) {
+	for msg := range ch {
+		c.insert(msg)
+	}
+}
+
+func (c *Cache) insert(msg *dns.Msg) {
+	if len(msg.Question) == 0 {
+		return
+	}
+	ttl := c.cacheableTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+	key := cacheKeyFor(msg)
+	now := time.Now()
+	entry := &cacheEntry{msg: msg.Copy(), insertedAt: now, expiresAt: now.Add(ttl)}
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+}
+
+func (c *Cache) cacheableTTL(msg *dns.Msg) time.Duration {
+	if isNegative(msg) {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := time.Duration(soa.Minttl) * time.Second
+				if ttl > c.maxNegativeTTL {
+					ttl = c.maxNegativeTTL
+				}
+				return ttl
+			}
+		}
+		return 0
+	}
+	ttl := minTTL(msg)
+	if ttl == 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func isNegative(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+}
+
+// ageOut returns a copy of msg with every RR's TTL decremented by the time
+// elapsed since insertedAt, per RFC 1035 caching semantics.
+func ageOut(msg *dns.Msg, insertedAt, now time.Time) *dns.Msg {
+	elapsed := uint32(now.Sub(insertedAt) / time.Second)
+	rMsg := msg.Copy()
+	for _, rrset := range [][]dns.RR{rMsg.Answer, rMsg.Ns, rMsg.Extra} {
+		for _, rr := range rrset {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return rMsg
+}
+
+func clampTTLs(msg *dns.Msg, ttl uint32) {
+	for _, rrset := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrset {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl
+		}
+	}
+}
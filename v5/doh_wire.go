@@ -0,0 +1,148 @@
+package dohProxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// WireContentType is the RFC 8484 media type for wire-format DNS messages.
+const WireContentType = "application/dns-message"
+
+// maxWireBodySize caps how much of a POST body answerWire will read. A wire
+// DNS message is at most 64KiB (the max TCP-DNS message size); anything
+// beyond that is rejected before it's buffered in memory.
+const maxWireBodySize = 64 * 1024
+
+// answerWire implements the RFC 8484 DoH wire-format endpoint: GET with a
+// base64url "dns" query parameter, or POST with an application/dns-message
+// body. It shares the relay/cache code paths with the legacy /resolve
+// handler.
+func (stub *Stub) answerWire(w http.ResponseWriter, r *http.Request) {
+	var raw []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		dnsParam := r.URL.Query().Get("dns")
+		if dnsParam == "" {
+			Log.Errorf("wire request missing dns parameter")
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing dns parameter."))
+			return
+		}
+		raw, err = base64.RawURLEncoding.DecodeString(dnsParam)
+		if err != nil {
+			Log.Errorf("decode dns parameter failed: %v", err)
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("decode dns parameter failed."))
+			return
+		}
+	case http.MethodPost:
+		ct := r.Header.Get("Content-Type")
+		if ct != "" && ct != WireContentType {
+			Log.Errorf("request content type not supported: %v", ct)
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = w.Write([]byte("request content type not supported."))
+			return
+		}
+		raw, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxWireBodySize))
+		if err != nil {
+			Log.Errorf("read request body failed: %v", err)
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("read request body failed."))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(raw); err != nil {
+		Log.Errorf("unpack dns message failed: %v", err)
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("unpack dns message failed."))
+		return
+	}
+
+	if stub.Filter != nil {
+		if rMsg := stub.Filter.Apply(q); rMsg != nil {
+			rMsg.Id = q.Id
+			stub.writeWireAnswer(rMsg, w)
+			return
+		}
+	}
+
+	if stub.UseCache {
+		rMsg := stub.cache.Get(q)
+		if rMsg != nil {
+			rMsg.Id = q.Id
+			Log.Infof("resolved from cache")
+			stub.writeWireAnswer(rMsg, w)
+			return
+		}
+	}
+
+	rMsg, err := stub.relay(q)
+	if err != nil {
+		Log.Errorf("error when querying upstream: %v", err)
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("error when querying upstream."))
+		return
+	}
+	stub.writeWireAnswer(rMsg, w)
+}
+
+// writeWireAnswer packs rMsg and writes it back as application/dns-message,
+// with a Cache-Control max-age derived from the lowest TTL in the response.
+func (stub *Stub) writeWireAnswer(rMsg *dns.Msg, w http.ResponseWriter) {
+	bytes_4_write, err := rMsg.Pack()
+	if err != nil {
+		Log.Errorf("error when packing response: %v", err)
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("error when packing response."))
+		return
+	}
+	w.Header().Set("Content-Type", WireContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(rMsg)))
+	w.WriteHeader(200)
+	_, err = w.Write(bytes_4_write)
+	if err != nil {
+		Log.Errorf("error when writing response: %v", err)
+		return
+	}
+}
+
+// minTTL returns the lowest TTL across Answer/Ns/Extra records, skipping the
+// pseudo-OPT record, or 0 if the message carries no records.
+func minTTL(msg *dns.Msg) uint32 {
+	var min uint32
+	found := false
+	for _, rrset := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrset {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl := rr.Header().Ttl
+			if !found || ttl < min {
+				min = ttl
+				found = true
+			}
+		}
+	}
+	if !found {
+		return 0
+	}
+	return min
+}
@@ -0,0 +1,354 @@
+package dohProxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// blockTTL is the TTL (and negative-caching SOA MINIMUM) handed out for
+// synthesized block/rewrite answers.
+const blockTTL uint32 = 300
+
+// ruleSourceTimeout bounds how long fetching a remote rule source may take,
+// so a slow or unreachable URL can't block Watch's refresh goroutine
+// indefinitely and silently stop all future scheduled refreshes.
+const ruleSourceTimeout = 30 * time.Second
+
+var ruleSourceClient = &http.Client{Timeout: ruleSourceTimeout}
+
+// RuleFormat selects how a rule source's lines are parsed.
+type RuleFormat int
+
+const (
+	// FormatHosts parses /etc/hosts-style "IP name" lines.
+	FormatHosts RuleFormat = iota
+	// FormatAdGuard parses AdGuard/uBlock-style block/allow/rewrite lines.
+	FormatAdGuard
+)
+
+// RuleSource is a local file or URL of filter rules in a given format.
+type RuleSource struct {
+	Location string
+	Format   RuleFormat
+}
+
+type filterAction int
+
+const (
+	actionBlock filterAction = iota
+	actionAllow
+	actionRewrite
+)
+
+type filterRule struct {
+	action      filterAction
+	wildcard    bool   // matches this domain and all its subdomains
+	rewriteIP   net.IP // hosts-file or dnsrewrite=<ip> target
+	rewriteHost string // dnsrewrite=<hostname> target
+}
+
+type filterNode struct {
+	children map[string]*filterNode
+	rule     *filterRule
+}
+
+// Filter is a domain blocklist/rewrite subsystem, consulted by Stub.answer
+// between generateMsgFromReq and relay. Rules are held in a reversed-label
+// trie for O(label-count) lookup with wildcard matching on parent domains.
+type Filter struct {
+	SinkholeIPv4 net.IP // if set, blocked A queries get this address instead of NXDOMAIN
+	SinkholeIPv6 net.IP // if set, blocked AAAA queries get this address instead of NXDOMAIN
+
+	mu   sync.RWMutex
+	root *filterNode
+
+	allowed   uint64
+	blocked   uint64
+	rewritten uint64
+}
+
+// NewFilter builds an empty Filter; call LoadSources to populate it.
+func NewFilter() *Filter {
+	return &Filter{root: &filterNode{children: make(map[string]*filterNode)}}
+}
+
+// LoadSources reads and parses every source, replacing the current rule set
+// atomically. A source that fails to load is logged and skipped, leaving
+// the others in effect.
+func (f *Filter) LoadSources(sources []RuleSource) error {
+	root := &filterNode{children: make(map[string]*filterNode)}
+	for _, src := range sources {
+		lines, err := readRuleSource(src.Location)
+		if err != nil {
+			Log.Errorf("load rule source %v failed: %v", src.Location, err)
+			continue
+		}
+		for _, line := range lines {
+			switch src.Format {
+			case FormatHosts:
+				insertHostsLine(root, line)
+			case FormatAdGuard:
+				insertAdGuardLine(root, line)
+			}
+		}
+	}
+	f.mu.Lock()
+	f.root = root
+	f.mu.Unlock()
+	return nil
+}
+
+// Watch refreshes the rule set from sources every interval until stop is
+// closed.
+func (f *Filter) Watch(sources []RuleSource, interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.LoadSources(sources); err != nil {
+					Log.Errorf("refresh rule sources failed: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func readRuleSource(location string) ([]string, error) {
+	var body []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		var resp *http.Response
+		resp, err = ruleSourceClient.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err = io.ReadAll(resp.Body)
+	} else {
+		body, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(body), "\n"), nil
+}
+
+func insertHostsLine(root *filterNode, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return
+	}
+	rule := &filterRule{action: actionRewrite, rewriteIP: ip}
+	for _, name := range fields[1:] {
+		insertRule(root, name, rule)
+	}
+}
+
+// insertAdGuardLine parses a single AdGuard/uBlock-style line:
+// "||example.com^" blocks, "@@||sub.example.com^" allows (overriding a
+// block on a parent domain), "example.com^$dnsrewrite=1.2.3.4" rewrites.
+func insertAdGuardLine(root *filterNode, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	action := actionBlock
+	if strings.HasPrefix(line, "@@") {
+		action = actionAllow
+		line = strings.TrimPrefix(line, "@@")
+	}
+
+	wildcard := false
+	if strings.HasPrefix(line, "||") {
+		wildcard = true
+		line = strings.TrimPrefix(line, "||")
+	}
+
+	end := strings.IndexByte(line, '^')
+	if end == -1 {
+		return
+	}
+	domain := line[:end]
+	modifiers := line[end+1:]
+
+	rule := &filterRule{action: action, wildcard: wildcard}
+	if rewrite := strings.TrimPrefix(modifiers, "$dnsrewrite="); rewrite != modifiers {
+		rule.action = actionRewrite
+		if ip := net.ParseIP(rewrite); ip != nil {
+			rule.rewriteIP = ip
+		} else {
+			rule.rewriteHost = rewrite
+		}
+	}
+	insertRule(root, domain, rule)
+}
+
+func insertRule(root *filterNode, domain string, rule *filterRule) {
+	node := root
+	for _, label := range reversedLabels(domain) {
+		child, ok := node.children[label]
+		if !ok {
+			child = &filterNode{children: make(map[string]*filterNode)}
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.rule = rule
+}
+
+func reversedLabels(domain string) []string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return nil
+	}
+	labels := strings.Split(domain, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// lookup walks the trie for name, preferring an exact match over the most
+// specific wildcard ancestor match found along the way.
+func (f *Filter) lookup(name string) *filterRule {
+	labels := reversedLabels(name)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	node := f.root
+	var wildcardMatch *filterRule
+	for i, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		node = child
+		if node.rule != nil && node.rule.wildcard {
+			wildcardMatch = node.rule
+		}
+		if i == len(labels)-1 && node.rule != nil {
+			return node.rule
+		}
+	}
+	return wildcardMatch
+}
+
+// Apply consults the filter for q's question and, if a block or rewrite
+// rule matches, returns a synthesized reply. It returns nil (and counts the
+// query as allowed) when nothing matches or an allow rule wins.
+func (f *Filter) Apply(q *dns.Msg) *dns.Msg {
+	if len(q.Question) == 0 {
+		return nil
+	}
+	name := q.Question[0].Name
+	rule := f.lookup(name)
+	if rule == nil || rule.action == actionAllow {
+		atomic.AddUint64(&f.allowed, 1)
+		return nil
+	}
+
+	switch rule.action {
+	case actionBlock:
+		atomic.AddUint64(&f.blocked, 1)
+		return f.blockResponse(q)
+	case actionRewrite:
+		atomic.AddUint64(&f.rewritten, 1)
+		return f.rewriteResponse(q, rule)
+	default:
+		return nil
+	}
+}
+
+func (f *Filter) blockResponse(q *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(q)
+	qtype := q.Question[0].Qtype
+	if qtype == dns.TypeA && f.SinkholeIPv4 != nil {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: blockTTL},
+			A:   f.SinkholeIPv4,
+		})
+		return m
+	}
+	if qtype == dns.TypeAAAA && f.SinkholeIPv6 != nil {
+		m.Answer = append(m.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: blockTTL},
+			AAAA: f.SinkholeIPv6,
+		})
+		return m
+	}
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, syntheticSOA(q.Question[0].Name))
+	return m
+}
+
+func (f *Filter) rewriteResponse(q *dns.Msg, rule *filterRule) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(q)
+	qtype := q.Question[0].Qtype
+	name := q.Question[0].Name
+
+	switch {
+	case rule.rewriteIP != nil && qtype == dns.TypeA && rule.rewriteIP.To4() != nil:
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: blockTTL},
+			A:   rule.rewriteIP,
+		})
+	case rule.rewriteIP != nil && qtype == dns.TypeAAAA && rule.rewriteIP.To4() == nil:
+		m.Answer = append(m.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: blockTTL},
+			AAAA: rule.rewriteIP,
+		})
+	case rule.rewriteHost != "":
+		m.Answer = append(m.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: blockTTL},
+			Target: dns.Fqdn(rule.rewriteHost),
+		})
+	default:
+		m.Ns = append(m.Ns, syntheticSOA(name))
+	}
+	return m
+}
+
+func syntheticSOA(name string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: blockTTL},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  blockTTL,
+	}
+}
+
+// statsHandler serves allowed/blocked/rewritten counters as JSON.
+func (f *Filter) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"allowed":%d,"blocked":%d,"rewritten":%d}`,
+		atomic.LoadUint64(&f.allowed), atomic.LoadUint64(&f.blocked), atomic.LoadUint64(&f.rewritten))
+}
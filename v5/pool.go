@@ -0,0 +1,220 @@
+package dohProxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPoolSize    = 8
+	defaultPoolIdleTTL = 30 * time.Second
+)
+
+// connPool is a bounded pool of dns.Conn for a single TCP/DoT upstream. It
+// exists because a *dns.Conn is not safe for concurrent Exchange calls, so
+// concurrent requests must each get their own connection rather than share
+// one.
+type connPool struct {
+	client  *dns.Client
+	addr    string
+	maxSize int
+	idleTTL time.Duration
+
+	mu   sync.Mutex
+	idle []pooledConn
+}
+
+type pooledConn struct {
+	conn     *dns.Conn
+	lastUsed time.Time
+}
+
+func newConnPool(client *dns.Client, addr string, maxSize int, idleTTL time.Duration) *connPool {
+	if maxSize <= 0 {
+		maxSize = defaultPoolSize
+	}
+	if idleTTL <= 0 {
+		idleTTL = defaultPoolIdleTTL
+	}
+	return &connPool{client: client, addr: addr, maxSize: maxSize, idleTTL: idleTTL}
+}
+
+// get returns an idle connection that hasn't exceeded idleTTL, discarding
+// any stale ones it finds along the way, or dials a new one.
+func (p *connPool) get() (*dns.Conn, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		last := len(p.idle) - 1
+		pc := p.idle[last]
+		p.idle = p.idle[:last]
+		if time.Since(pc.lastUsed) > p.idleTTL {
+			_ = pc.conn.Close()
+			continue
+		}
+		p.mu.Unlock()
+		return pc.conn, nil
+	}
+	p.mu.Unlock()
+	return p.client.Dial(p.addr)
+}
+
+// put returns a healthy connection to the pool, closing it instead if the
+// pool is already at capacity.
+func (p *connPool) put(conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= p.maxSize {
+		_ = conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pooledConn{conn: conn, lastUsed: time.Now()})
+}
+
+// discard closes a connection that errored rather than returning it to the
+// pool, so broken conns never get reused.
+func (p *connPool) discard(conn *dns.Conn) {
+	_ = conn.Close()
+}
+
+// closeAll closes every idle connection currently held by the pool.
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.idle {
+		_ = pc.conn.Close()
+	}
+	p.idle = nil
+}
+
+// udpMux multiplexes many concurrent queries over a single UDP socket,
+// keyed by dns.Msg.Id, since UDP tolerates this well and avoids one socket
+// per in-flight query.
+type udpMux struct {
+	client *dns.Client
+	addr   string
+
+	mu      sync.Mutex
+	conn    *dns.Conn
+	nextID  uint16
+	pending map[uint16]chan *dns.Msg
+}
+
+func newUDPMux(client *dns.Client, addr string) *udpMux {
+	return &udpMux{client: client, addr: addr, pending: make(map[uint16]chan *dns.Msg)}
+}
+
+// close shuts down the shared socket; readLoop sees the resulting read
+// error and fails any still-pending queries.
+func (m *udpMux) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		_ = m.conn.Close()
+		m.conn = nil
+	}
+}
+
+func (m *udpMux) ensureConn() (*dns.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		return m.conn, nil
+	}
+	conn, err := m.client.Dial(m.addr)
+	if err != nil {
+		return nil, err
+	}
+	m.conn = conn
+	go m.readLoop(conn)
+	return conn, nil
+}
+
+// readLoop owns the single socket read side, dispatching each response to
+// the channel registered under its query ID. It exits, failing all pending
+// queries, once the connection breaks.
+func (m *udpMux) readLoop(conn *dns.Conn) {
+	for {
+		rMsg, err := conn.ReadMsg()
+		if err != nil {
+			m.mu.Lock()
+			if m.conn == conn {
+				m.conn = nil
+			}
+			pending := m.pending
+			m.pending = make(map[uint16]chan *dns.Msg)
+			m.mu.Unlock()
+			for _, ch := range pending {
+				close(ch)
+			}
+			return
+		}
+		m.mu.Lock()
+		ch, ok := m.pending[rMsg.Id]
+		if ok {
+			delete(m.pending, rMsg.Id)
+		}
+		m.mu.Unlock()
+		if ok {
+			ch <- rMsg
+			close(ch)
+		}
+	}
+}
+
+// Exchange assigns its own wire ID to msg instead of trusting the caller's
+// Id to be unique among concurrently in-flight queries on this socket
+// (random 16-bit IDs collide under load, and wire-format clients routinely
+// send Id: 0). The caller's original Id is restored on the response.
+func (m *udpMux) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	conn, err := m.ensureConn()
+	if err != nil {
+		return nil, err
+	}
+
+	originalID := msg.Id
+	wireID, ch := m.register()
+
+	out := msg.Copy()
+	out.Id = wireID
+	if err := conn.WriteMsg(out); err != nil {
+		m.mu.Lock()
+		delete(m.pending, wireID)
+		m.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case rMsg, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("upstream udp connection closed")
+		}
+		rMsg.Id = originalID
+		return rMsg, nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		delete(m.pending, wireID)
+		m.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// register allocates a wire ID that isn't already pending and reserves it
+// for ch, so concurrent queries can never collide on the same ID even if
+// their caller-supplied Ids do.
+func (m *udpMux) register() (uint16, chan *dns.Msg) {
+	ch := make(chan *dns.Msg, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		m.nextID++
+		id := m.nextID
+		if _, taken := m.pending[id]; !taken {
+			m.pending[id] = ch
+			return id, ch
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package dohProxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestAnswerConcurrentRace fires thousands of concurrent /resolve requests
+// through a single UDP upstream so `go test -race` can catch the kind of
+// shared-state bug the old global client/conn had, and the udp
+// multiplexer/connection pool that replaced it must not reintroduce: each
+// request must get back the answer for its own question, never another
+// in-flight request's.
+func TestAnswerConcurrentRace(t *testing.T) {
+	upstreamAddr := startEchoUDPUpstream(t)
+	stub := &Stub{Upstreams: []string{"udp://" + upstreamAddr}}
+
+	server := httptest.NewServer(http.HandlerFunc(stub.answer))
+	defer server.Close()
+
+	const n = 2000
+	var wg sync.WaitGroup
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.example.com.", i)
+			reqURL := fmt.Sprintf("%s/resolve?name=%s&type=1&edns_client_subnet=1.2.3.4/32", server.URL, name)
+			resp, err := http.Get(reqURL)
+			if err != nil {
+				errCh <- fmt.Errorf("%v: %v", name, err)
+				return
+			}
+			defer func() { _ = resp.Body.Close() }()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				errCh <- fmt.Errorf("%v: read body: %v", name, err)
+				return
+			}
+			rMsg := new(dns.Msg)
+			if err := rMsg.Unpack(body); err != nil {
+				errCh <- fmt.Errorf("%v: unpack: %v", name, err)
+				return
+			}
+			if len(rMsg.Question) == 0 || rMsg.Question[0].Name != dns.Fqdn(name) {
+				errCh <- fmt.Errorf("%v: got mismatched answer %v", name, rMsg)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+// startEchoUDPUpstream starts a minimal UDP DNS server that answers every
+// question with an A record matching the question's own name, so the test
+// above can detect a query being answered with someone else's response.
+func startEchoUDPUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			rMsg := new(dns.Msg)
+			rMsg.SetReply(q)
+			if len(q.Question) > 0 {
+				rMsg.Answer = append(rMsg.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(127, 0, 0, 1),
+				})
+			}
+			out, err := rMsg.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteToUDP(out, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,117 @@
+package dohProxy
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultShutdownTimeout = 10 * time.Second
+	serverReadTimeout      = 10 * time.Second
+	serverWriteTimeoutMin  = 10 * time.Second
+	serverWriteTimeoutPad  = 5 * time.Second
+	serverIdleTimeout      = 120 * time.Second
+)
+
+// serverWriteTimeout returns the WriteTimeout to serve with: comfortably
+// longer than relay's worst-case failover time across all configured
+// upstreams, so the server never cuts a client connection mid-failover and
+// silently defeats relay's retry/failover.
+func serverWriteTimeout(upstreamCount int) time.Duration {
+	if budget := relayBudget(upstreamCount) + serverWriteTimeoutPad; budget > serverWriteTimeoutMin {
+		return budget
+	}
+	return serverWriteTimeoutMin
+}
+
+// Run starts the stub server and blocks until it shuts down. DoH clients
+// are served over TLS/HTTP2 by default: either a static CertFile/KeyFile
+// pair, or ACME via autocert when AutocertHosts is set. Insecure serves
+// plain HTTP instead, for local testing only. SIGINT/SIGTERM trigger a
+// graceful shutdown that drains in-flight queries and closes the upstream
+// pool before returning.
+func (stub *Stub) Run() {
+	if stub.UseCache {
+		stub.cache = NewCache(stub.MaxNegativeTTL, stub.StaleTTL, stub.ServeStale)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resolve", stub.answer)
+	mux.HandleFunc("/dns-query", stub.answerWire)
+	if stub.Filter != nil {
+		mux.HandleFunc("/stats", stub.Filter.statsHandler)
+	}
+
+	server := &http.Server{
+		Addr:         stub.ListenAddr,
+		Handler:      mux,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout(len(stub.Upstreams)),
+		IdleTimeout:  serverIdleTimeout,
+	}
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		Log.Fatalf("configure http2 failed: %v", err)
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		Log.Info("received shutdown signal, draining in-flight queries...")
+
+		timeout := stub.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			Log.Errorf("graceful shutdown failed: %v", err)
+		}
+		close(shutdownDone)
+	}()
+
+	var err error
+	switch {
+	case stub.Insecure:
+		Log.Infof("running stub server http://%v <--> %v ...", stub.ListenAddr, stub.Upstreams)
+		err = server.ListenAndServe()
+	case len(stub.AutocertHosts) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(stub.AutocertHosts...),
+			Cache:      autocert.DirCache(stub.AutocertCacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		Log.Infof("running stub server https://%v (autocert) <--> %v ...", stub.ListenAddr, stub.Upstreams)
+		err = server.ListenAndServeTLS("", "")
+	default:
+		Log.Infof("running stub server https://%v <--> %v ...", stub.ListenAddr, stub.Upstreams)
+		err = server.ListenAndServeTLS(stub.CertFile, stub.KeyFile)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		Log.Fatalf("stub server running into error: %v", err)
+	}
+
+	<-shutdownDone
+	stub.closeUpstreams()
+	Log.Info("stopping stub server...")
+}
+
+// closeUpstreams closes any pooled connections held by the parsed
+// upstreams, releasing their sockets on shutdown.
+func (stub *Stub) closeUpstreams() {
+	for _, up := range stub.upstreams {
+		if closer, ok := up.(interface{ Close() error }); ok {
+			_ = closer.Close()
+		}
+	}
+}
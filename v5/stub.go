@@ -1,49 +1,101 @@
 package dohProxy
 
 import (
+	"context"
 	"fmt"
 	"github.com/miekg/dns"
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type Stub struct {
-	ListenAddr       string
-	UpstreamAddr     string
-	UpstreamProtocol string // tcp or udp
-	UseCache         bool
+	ListenAddr     string
+	Upstreams      []string      // upstream URLs, e.g. udp://1.1.1.1:53, tcp-tls://1.1.1.1:853#cloudflare-dns.com, https://dns.google/dns-query
+	Bootstrap      string        // upstream URL used to resolve upstream hostnames, e.g. udp://1.1.1.1:53; empty uses the system resolver
+	PoolSize       int           // max idle connections kept per tcp(-tls) upstream; 0 uses defaultPoolSize
+	PoolIdleTTL    time.Duration // how long an idle pooled connection is kept before being discarded; 0 uses defaultPoolIdleTTL
+	UseCache       bool
+	MaxNegativeTTL time.Duration // cap on how long NXDOMAIN/NODATA answers are cached; 0 uses defaultMaxNegativeTTL
+	ServeStale     bool          // RFC 8767: serve an expired cache entry (within StaleTTL) if the upstream relay fails
+	StaleTTL       time.Duration // how long past expiry a stale entry may still be served; 0 uses defaultStaleTTL
+	Filter         *Filter       // optional blocklist/rewrite subsystem consulted before relaying
+
+	Insecure         bool          // serve plain HTTP instead of TLS; for local testing only
+	CertFile         string        // TLS certificate, unused when Autocert is enabled
+	KeyFile          string        // TLS private key, unused when Autocert is enabled
+	AutocertHosts    []string      // non-empty enables ACME via autocert, restricted to these hostnames
+	AutocertCacheDir string        // autocert certificate cache directory
+	ShutdownTimeout  time.Duration // how long Run waits for in-flight queries to drain on SIGINT/SIGTERM; 0 uses defaultShutdownTimeout
+
+	// cache and the resolved upstreams are owned by this Stub instance (not
+	// package state), so two differently-configured Stubs in the same
+	// process never see each other's state and each can be configured
+	// independently. The upstreams are built lazily, at most once, on first
+	// use; the cache is built by Run when UseCache is set.
+	once         sync.Once
+	cache        *Cache
+	upstreams    []Upstream
+	bootstream   Upstream
+	upstreamsErr error
 }
 
-var (
-	client *dns.Client
-	conn   *dns.Conn
-	cache  *Cache
+const (
+	relayRetryAttempts  = 3
+	relayRetryBaseWait  = 200 * time.Millisecond
+	relayAttemptTimeout = 5 * time.Second
 )
 
-func (stub Stub) ensureConn() error {
-	if client == nil {
-		client = &dns.Client{
-			Net: stub.UpstreamProtocol,
-			ReadTimeout: 5,
-			WriteTimeout: 5,
-			DialTimeout: 5,
-		}
+// relayBudget returns the worst-case time relayUpstream can spend trying
+// upstreamCount upstreams: every attempt timing out plus the backoff between
+// retries. Callers that impose their own deadline on the whole relay (e.g.
+// the HTTP server's WriteTimeout) must allow at least this long, or they'll
+// cut the connection before failover has a chance to work.
+func relayBudget(upstreamCount int) time.Duration {
+	var backoff time.Duration
+	for attempt := 1; attempt < relayRetryAttempts; attempt++ {
+		backoff += relayRetryBaseWait * time.Duration(uint(1)<<uint(attempt-1))
 	}
-	if conn != nil {
-		return nil
-	}
-	conn_, err := client.Dial(stub.UpstreamAddr)
-	if err != nil {
-		Log.Errorf("connect to upstream server %v://%v failed: %v",
-			stub.UpstreamProtocol, stub.UpstreamAddr, err)
-		return err
-	}
-	conn = conn_
-	return nil
+	perUpstream := relayRetryAttempts*relayAttemptTimeout + backoff
+	return time.Duration(upstreamCount) * perUpstream
+}
+
+// ensureUpstreams lazily parses stub.Upstreams (and stub.Bootstrap, if set)
+// into Upstream implementations, caching the result on stub for subsequent
+// calls. Initialization runs at most once even under concurrent callers.
+func (stub *Stub) ensureUpstreams() ([]Upstream, error) {
+	stub.once.Do(func() {
+		if stub.Bootstrap != "" {
+			b, err := parseUpstream(stub.Bootstrap, nil, stub.PoolSize, stub.PoolIdleTTL)
+			if err != nil {
+				Log.Errorf("parse bootstrap upstream %v failed: %v", stub.Bootstrap, err)
+				stub.upstreamsErr = err
+				return
+			}
+			stub.bootstream = b
+		}
+		parsed := make([]Upstream, 0, len(stub.Upstreams))
+		for _, raw := range stub.Upstreams {
+			u, err := parseUpstream(raw, stub.bootstream, stub.PoolSize, stub.PoolIdleTTL)
+			if err != nil {
+				Log.Errorf("parse upstream %v failed: %v", raw, err)
+				stub.upstreamsErr = err
+				return
+			}
+			parsed = append(parsed, u)
+		}
+		if len(parsed) == 0 {
+			stub.upstreamsErr = fmt.Errorf("no upstream configured")
+			return
+		}
+		stub.upstreams = parsed
+	})
+	return stub.upstreams, stub.upstreamsErr
 }
 
-func (stub Stub) answer(w http.ResponseWriter, r *http.Request) {
+func (stub *Stub) answer(w http.ResponseWriter, r *http.Request) {
 	accept_in_req := r.Header.Get("Accept")
 	if accept_in_req != "" && accept_in_req != "*/*" && accept_in_req != ContentType {
 		Log.Errorf("request content type not supported: %v", accept_in_req)
@@ -69,8 +121,16 @@ func (stub Stub) answer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if stub.Filter != nil {
+		if rMsg := stub.Filter.Apply(q); rMsg != nil {
+			rMsg.Id = q.Id
+			stub.writeAnswer(rMsg, w)
+			return
+		}
+	}
+
 	if stub.UseCache {
-		rMsg := cache.Get(q)
+		rMsg := stub.cache.Get(q)
 		if rMsg != nil {
 			rMsg.Id = q.Id
 			Log.Infof("resolved from cache")
@@ -94,7 +154,7 @@ func (stub Stub) answer(w http.ResponseWriter, r *http.Request) {
 	stub.writeAnswer(rMsg, w)
 }
 
-func (stub Stub) writeAnswer(rMsg *dns.Msg, w http.ResponseWriter) {
+func (stub *Stub) writeAnswer(rMsg *dns.Msg, w http.ResponseWriter) {
 	bytes_4_write, err := rMsg.Pack()
 	if err != nil {
 		Log.Errorf("error when querying upstream: %v", err)
@@ -115,32 +175,74 @@ func (stub Stub) writeAnswer(rMsg *dns.Msg, w http.ResponseWriter) {
 	}
 }
 
-func (stub Stub) relay(msg *dns.Msg) (*dns.Msg, error) {
-	err := stub.ensureConn()
-	if err != nil {
-		client = nil
-		conn = nil
-		return nil, fmt.Errorf("client connecting error")
+// relay tries each configured upstream in order, making up to
+// relayRetryAttempts attempts on each one with exponential backoff between
+// them before falling through to the next upstream. A network error or
+// SERVFAIL counts as a failed attempt. If every upstream fails and
+// serve-stale is enabled, a stale cache entry is returned instead and
+// refreshed in the background.
+func (stub *Stub) relay(msg *dns.Msg) (*dns.Msg, error) {
+	rMsg, err := stub.relayUpstream(msg)
+	if err != nil && stub.UseCache && stub.ServeStale {
+		if stale := stub.cache.GetStale(msg); stale != nil {
+			stale.Id = msg.Id
+			Log.Infof("serving stale cache entry after relay error: %v", err)
+			go stub.refreshStale(msg)
+			return stale, nil
+		}
+	}
+	return rMsg, err
+}
+
+// refreshStale re-relays msg in the background to repopulate the cache
+// after a stale entry was served.
+func (stub *Stub) refreshStale(msg *dns.Msg) {
+	if _, err := stub.relayUpstream(msg); err != nil {
+		Log.Errorf("stale refresh failed: %v", err)
 	}
-	rMsg, _, err := client.ExchangeWithConn(msg, conn)
+}
+
+func (stub *Stub) relayUpstream(msg *dns.Msg) (*dns.Msg, error) {
+	ups, err := stub.ensureUpstreams()
 	if err != nil {
-		client = nil
-		conn = nil
-		Log.Errorf("error when relaying query: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("upstream configuration error: %v", err)
 	}
-	if stub.UseCache {
-		msgch := make(chan *dns.Msg)
-		defer close(msgch)
-		go cache.Insert(msgch)
-		msgch <- rMsg
-	}
-	Log.Debugf("upstream answer: %v", rMsg)
-	Log.Infof("resolved from upstream for: %v", rMsg.Question[0].String())
-	return rMsg, nil
+
+	var lastErr error
+	for _, up := range ups {
+		for attempt := 0; attempt < relayRetryAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(relayRetryBaseWait * time.Duration(uint(1)<<uint(attempt-1)))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), relayAttemptTimeout)
+			rMsg, err := up.Exchange(ctx, msg)
+			cancel()
+			if err != nil {
+				lastErr = err
+				Log.Errorf("relay to upstream failed (attempt %v): %v", attempt+1, err)
+				continue
+			}
+			if rMsg.Rcode == dns.RcodeServerFailure {
+				lastErr = fmt.Errorf("upstream returned SERVFAIL")
+				Log.Errorf("upstream returned SERVFAIL (attempt %v)", attempt+1)
+				continue
+			}
+			if stub.UseCache {
+				msgch := make(chan *dns.Msg)
+				defer close(msgch)
+				go stub.cache.Insert(msgch)
+				msgch <- rMsg
+			}
+			Log.Debugf("upstream answer: %v", rMsg)
+			Log.Infof("resolved from upstream for: %v", rMsg.Question[0].String())
+			return rMsg, nil
+		}
+	}
+	Log.Errorf("all upstreams exhausted: %v", lastErr)
+	return nil, fmt.Errorf("all upstreams exhausted: %v", lastErr)
 }
 
-func (stub Stub) generateMsgFromReq(r *http.Request) (*dns.Msg, error) {
+func (stub *Stub) generateMsgFromReq(r *http.Request) (*dns.Msg, error) {
 	qMsg := new(dns.Msg)
 	qMsg.Id = dns.Id()
 	qMsg.Response = false
@@ -211,18 +313,3 @@ func (stub Stub) generateMsgFromReq(r *http.Request) (*dns.Msg, error) {
 	ReplaceEDNS0Subnet(qMsg, subnet)
 	return qMsg, nil
 }
-
-func (stub Stub) Run() {
-	if stub.UseCache {
-		cache = NewCache()
-	}
-	http.HandleFunc("/resolve", stub.answer)
-	Log.Infof("running stub server http://%v <--> %v://%v ...",
-		stub.ListenAddr, stub.UpstreamProtocol, stub.UpstreamAddr)
-	err := http.ListenAndServe(stub.ListenAddr, nil)
-	if err != nil {
-		Log.Fatalf("stub server running into error: %v", err)
-	}
-	_ = conn.Close()
-	Log.Info("stopping stub server...")
-}
@@ -0,0 +1,242 @@
+package dohProxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+// Upstream is a single resolver an incoming query can be relayed to,
+// regardless of the underlying transport (plain UDP/TCP, DoT or DoH).
+type Upstream interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// dnsUpstream relays over the classic DNS wire protocol, plain (udp/tcp) or
+// wrapped in TLS (tcp-tls). udp://  upstreams multiplex over a single socket
+// via mux; tcp(-tls):// upstreams borrow a connection from pool per query,
+// since a *dns.Conn is not safe for concurrent use.
+type dnsUpstream struct {
+	client *dns.Client
+	pool   *connPool
+	mux    *udpMux
+}
+
+func (u *dnsUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if u.mux != nil {
+		return u.mux.Exchange(ctx, msg)
+	}
+	conn, err := u.pool.get()
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	rMsg, _, err := u.client.ExchangeWithConn(msg, conn)
+	if err != nil {
+		u.pool.discard(conn)
+		return nil, err
+	}
+	u.pool.put(conn)
+	return rMsg, nil
+}
+
+// Close releases the idle connections held by this upstream's pool or
+// multiplexer.
+func (u *dnsUpstream) Close() error {
+	if u.mux != nil {
+		u.mux.close()
+	}
+	if u.pool != nil {
+		u.pool.closeAll()
+	}
+	return nil
+}
+
+// dohUpstream relays by POSTing application/dns-message to a DoH server.
+type dohUpstream struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", WireContentType)
+	req.Header.Set("Accept", WireContentType)
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream %v returned status %v", u.url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	rMsg := new(dns.Msg)
+	if err := rMsg.Unpack(body); err != nil {
+		return nil, err
+	}
+	return rMsg, nil
+}
+
+// Close idles down the underlying HTTP/2 transport's connections.
+func (u *dohUpstream) Close() error {
+	u.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// parseUpstream turns an upstream URL-ish string into an Upstream. Supported
+// schemes: udp://host:port, tcp://host:port, tcp-tls://host:port(#sni) and
+// https://host[:port]/path. bootstrap, when non-nil, is used to resolve
+// hostnames instead of the system resolver. poolSize/poolIdleTTL configure
+// the connection pool backing tcp(-tls) upstreams; zero values fall back to
+// their defaults.
+func parseUpstream(raw string, bootstrap Upstream, poolSize int, poolIdleTTL time.Duration) (Upstream, error) {
+	parsedURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %v", raw, err)
+	}
+
+	switch parsedURL.Scheme {
+	case "udp":
+		addr, err := resolveHostPort(parsedURL.Host, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		client := &dns.Client{
+			Net:          "udp",
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			DialTimeout:  5 * time.Second,
+		}
+		return &dnsUpstream{client: client, mux: newUDPMux(client, addr)}, nil
+	case "tcp":
+		addr, err := resolveHostPort(parsedURL.Host, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		client := &dns.Client{
+			Net:          "tcp",
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			DialTimeout:  5 * time.Second,
+		}
+		return &dnsUpstream{client: client, pool: newConnPool(client, addr, poolSize, poolIdleTTL)}, nil
+	case "tcp-tls":
+		addr, err := resolveHostPort(parsedURL.Host, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		serverName := parsedURL.Fragment
+		if serverName == "" {
+			serverName, _, err = net.SplitHostPort(parsedURL.Host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream %q: %v", raw, err)
+			}
+		}
+		client := &dns.Client{
+			Net:          "tcp-tls",
+			TLSConfig:    &tls.Config{ServerName: serverName},
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			DialTimeout:  5 * time.Second,
+		}
+		return &dnsUpstream{client: client, pool: newConnPool(client, addr, poolSize, poolIdleTTL)}, nil
+	case "https":
+		return parseDoHUpstream(parsedURL, bootstrap)
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %q", parsedURL.Scheme)
+	}
+}
+
+func parseDoHUpstream(parsedURL *url.URL, bootstrap Upstream) (Upstream, error) {
+	host := parsedURL.Hostname()
+	port := parsedURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	dialHost := host
+	if net.ParseIP(host) == nil && bootstrap != nil {
+		resolved, err := bootstrapLookup(bootstrap, host)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap resolve of %q failed: %v", host, err)
+		}
+		dialHost = resolved
+	}
+	dialAddr := net.JoinHostPort(dialHost, port)
+
+	path := parsedURL.Path
+	if path == "" {
+		path = "/dns-query"
+	}
+	endpoint := (&url.URL{Scheme: "https", Host: net.JoinHostPort(host, port), Path: path}).String()
+
+	transport := &http2.Transport{
+		TLSClientConfig: &tls.Config{ServerName: host},
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			dialer := &tls.Dialer{Config: cfg}
+			return dialer.DialContext(ctx, network, dialAddr)
+		},
+	}
+	return &dohUpstream{
+		url:        endpoint,
+		httpClient: &http.Client{Transport: transport, Timeout: 5 * time.Second},
+	}, nil
+}
+
+// resolveHostPort resolves the host part of a host:port pair via bootstrap
+// when it isn't already an IP literal; bootstrap == nil falls back to the
+// system resolver by leaving the hostname as-is for the dns.Client to dial.
+func resolveHostPort(hostport string, bootstrap Upstream) (string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", fmt.Errorf("invalid upstream address %q: %v", hostport, err)
+	}
+	if net.ParseIP(host) != nil || bootstrap == nil {
+		return hostport, nil
+	}
+	resolved, err := bootstrapLookup(bootstrap, host)
+	if err != nil {
+		return "", fmt.Errorf("bootstrap resolve of %q failed: %v", host, err)
+	}
+	return net.JoinHostPort(resolved, port), nil
+}
+
+// bootstrapLookup resolves host to an IPv4 address using the bootstrap
+// upstream, bypassing the system resolver entirely.
+func bootstrapLookup(bootstrap Upstream, host string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rMsg, err := bootstrap.Exchange(ctx, m)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range rMsg.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no A record found for %v", host)
+}